@@ -0,0 +1,383 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// refreshState tracks conditional-GET and failure state for one feed, or one
+// discovery source (keyed by "discovery:" + its URL; "discovery" itself is
+// used for the overall backoff/failure count across every source). body
+// caches the last fetched discovery blob so a 304 from one source doesn't
+// drop the others out of the merge.
+type refreshState struct {
+	etag         string
+	lastModified string
+	body         []byte
+	failures     int
+}
+
+var (
+	refreshStatesMu sync.Mutex
+	refreshStates   = map[string]*refreshState{}
+
+	publishMu sync.Mutex // serializes publish cycles across feed/discovery timers
+
+	hupMu sync.Mutex
+	hupCh = make(chan struct{})
+)
+
+func getRefreshState(key string) *refreshState {
+	refreshStatesMu.Lock()
+	defer refreshStatesMu.Unlock()
+	s, ok := refreshStates[key]
+	if !ok {
+		s = &refreshState{}
+		refreshStates[key] = s
+	}
+	return s
+}
+
+// currentHup returns the channel that SIGHUP closes to wake every feed loop.
+func currentHup() chan struct{} {
+	hupMu.Lock()
+	defer hupMu.Unlock()
+	return hupCh
+}
+
+// broadcastHup wakes every feed loop waiting on currentHup() and arms a fresh channel.
+func broadcastHup() {
+	hupMu.Lock()
+	close(hupCh)
+	hupCh = make(chan struct{})
+	hupMu.Unlock()
+}
+
+func mustParseSeconds(key string) time.Duration {
+	seconds, err := strconv.Atoi(config[key])
+	if err != nil {
+		log.Fatalf("ERROR: invalid value for '%s': %s", key, err)
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// intervalFor returns the configured refresh interval for a feed, falling
+// back to the "refreshinterval" default when the tuple didn't specify one.
+func intervalFor(feed feedtuple) time.Duration {
+	if feed.interval > 0 {
+		return feed.interval
+	}
+	return mustParseSeconds("refreshinterval")
+}
+
+// jitter perturbs d by up to +/- "jitterseconds" so feeds refreshing on the
+// same interval don't all hit WAYF at once.
+func jitter(d time.Duration) time.Duration {
+	maxJitter := mustParseSeconds("jitterseconds")
+	if maxJitter <= 0 {
+		return d
+	}
+	offset := time.Duration(rand.Int63n(int64(2*maxJitter))) - maxJitter
+	if d+offset < 0 {
+		return d
+	}
+	return d + offset
+}
+
+// backoff returns an exponentially increasing delay capped at
+// "maxbackoffseconds", based on the number of consecutive failures already
+// observed for a feed. Jitter is applied after the cap, so the returned delay
+// may exceed "maxbackoffseconds" by up to "jitterseconds".
+func backoff(failures int) time.Duration {
+	maxBackoff := mustParseSeconds("maxbackoffseconds")
+	delay := time.Second * time.Duration(1<<uint(failures))
+	if delay <= 0 || delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return jitter(delay)
+}
+
+// runDaemon runs the fetch/validate/publish pipeline forever, once per feed on
+// its own interval plus the discovery feed on its own, until the process
+// receives SIGTERM. SIGHUP forces an immediate refresh of everything.
+func runDaemon() {
+	stop := make(chan struct{})
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range sigCh {
+			switch sig {
+			case syscall.SIGHUP:
+				log.Printf("received SIGHUP, forcing immediate refresh of all feeds")
+				broadcastHup()
+			case syscall.SIGTERM:
+				log.Printf("received SIGTERM, finishing in-flight cycle then exiting")
+				close(stop)
+				return
+			}
+		}
+	}()
+
+	if httpConfig["mdqlisten"] != "" {
+		server, err := newMDQServer(config["basefolder"]+"/"+config["symlinkfolder"], httpConfig["signkeypath"])
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		go func() {
+			log.Printf("MDQ server listening on %s", httpConfig["mdqlisten"])
+			log.Fatal(http.ListenAndServe(httpConfig["mdqlisten"], server.ServeMux()))
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for _, feed := range feeds {
+		wg.Add(1)
+		go func(feed feedtuple) {
+			defer wg.Done()
+			feedLoop(feed, stop)
+		}(feed)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		discoveryLoop(stop)
+	}()
+
+	wg.Wait()
+	log.Printf("OK: lMDQ daemon stopped")
+}
+
+// feedLoop refreshes a single feed on its own schedule until stop is closed.
+func feedLoop(feed feedtuple, stop <-chan struct{}) {
+	for {
+		if err := refreshFeed(feed); err != nil {
+			log.Printf("ERROR: refresh of feed '%s' failed: %s", feed.name, err)
+		}
+
+		state := getRefreshState(feed.name)
+		delay := jitter(intervalFor(feed))
+		if state.failures > 0 {
+			delay = backoff(state.failures)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-currentHup():
+		case <-time.After(delay):
+		}
+	}
+}
+
+// discoveryLoop refreshes the discovery feed on its own schedule.
+func discoveryLoop(stop <-chan struct{}) {
+	for {
+		if err := refreshDiscovery(); err != nil {
+			log.Printf("ERROR: refresh of discovery feed failed: %s", err)
+		}
+
+		state := getRefreshState("discovery")
+		delay := jitter(mustParseSeconds("discoveryinterval"))
+		if state.failures > 0 {
+			delay = backoff(state.failures)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-currentHup():
+		case <-time.After(delay):
+		}
+	}
+}
+
+// refreshFeed fetches, validates and (if changed) publishes a single feed.
+func refreshFeed(feed feedtuple) (err error) {
+	state := getRefreshState(feed.name)
+
+	start := time.Now()
+	body, notModified, etag, lastModified, err := fetchData(feed.url, state.etag, state.lastModified)
+	recordFetchDuration(feed.name, time.Since(start).Seconds())
+	if err != nil {
+		state.failures++
+		return
+	}
+	if notModified {
+		log.Printf("feed '%s' unchanged since last fetch, skipping publish", feed.name)
+		state.failures = 0
+		return nil
+	}
+
+	if err = validateMetadata(body, config["metadataschemapath"], feed.trust, feed.mode, feed.name); err != nil {
+		state.failures++
+		recordValidationFailure(feed.name)
+		return
+	}
+
+	if err = publish(map[string][]byte{feed.name: body}, nil); err != nil {
+		state.failures++
+		return
+	}
+
+	state.etag = etag
+	state.lastModified = lastModified
+	state.failures = 0
+	return nil
+}
+
+// refreshDiscovery fetches every configured discovery source (config
+// "discoveryurl" is a ';;' separated list, same convention as metadataurl),
+// merges and filters them into a single feed and, if any source actually
+// changed, publishes it. The merge always runs over every source's latest
+// state rather than just the one that changed, so a publish never drops
+// entries from a source that happened not to change this cycle.
+func refreshDiscovery() (err error) {
+	overall := getRefreshState("discovery")
+	urls := strings.Split(config["discoveryurl"], ";;")
+
+	// New validators are only remembered once the publish succeeds, so a
+	// failed cycle refetches (and republishes) the change next time round.
+	type validators struct{ etag, lastModified string }
+	fresh := map[*refreshState]validators{}
+	blobs := make([][]byte, len(urls))
+	for i, url := range urls {
+		state := getRefreshState("discovery:" + url)
+
+		start := time.Now()
+		body, notModified, etag, lastModified, fetchErr := fetchData(url, state.etag, state.lastModified)
+		recordFetchDuration("discovery", time.Since(start).Seconds())
+		if fetchErr != nil {
+			overall.failures++
+			return fetchErr
+		}
+		if notModified {
+			blobs[i] = state.body
+			continue
+		}
+
+		blobs[i] = body
+		state.body = body
+		fresh[state] = validators{etag, lastModified}
+	}
+
+	if len(fresh) == 0 {
+		overall.failures = 0
+		return nil
+	}
+
+	merged, err := mergeDiscoveryFeeds(blobs, splitCSV(discoveryConfig["discoveryentitycategories"]), splitCSV(discoveryConfig["discoveryregistrationauthority"]))
+	if err != nil {
+		overall.failures++
+		return
+	}
+
+	if err = publish(nil, merged); err != nil {
+		overall.failures++
+		return
+	}
+
+	for state, v := range fresh {
+		state.etag, state.lastModified = v.etag, v.lastModified
+	}
+	overall.failures = 0
+	return nil
+}
+
+// publish builds the next generation of the MDQ tree. changedFeeds/changedDiscovery
+// carry freshly fetched, already-validated data for whatever triggered this cycle;
+// everything else is copied forward unchanged from the currently published
+// generation, so a feed refreshing on its own schedule doesn't have to wait for
+// (or republish) its neighbours.
+func publish(changedFeeds map[string][]byte, changedDiscovery []byte) (err error) {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+
+	folderName, err := createDateTimeFolder(config["basefolder"], config["datafoldernameformat"])
+	if err != nil {
+		return
+	}
+
+	oldFolder, _ := filepath.EvalSymlinks(config["basefolder"] + "/" + config["symlinkfolder"])
+
+	for _, feed := range feeds {
+		if body, ok := changedFeeds[feed.name]; ok {
+			var entityCount int
+			if entityCount, err = createMDQFiles(body, folderName, feed.name, feed.trust, feed.mode); err != nil {
+				return
+			}
+			recordFeedStatus(feed.name, entityCount)
+			setEntitiesTotal(feed.name, entityCount)
+			setLastSuccess(feed.name, time.Now())
+		} else if oldFolder != "" {
+			if err = copyPublishedFolder(oldFolder, folderName, feed.name); err != nil {
+				return
+			}
+		}
+	}
+
+	if changedDiscovery != nil {
+		if err = createDiscoServiceFile(changedDiscovery, folderName, "discofeed", "wayf-interfed.discofeed.jsgz"); err != nil {
+			return
+		}
+		setLastSuccess("discovery", time.Now())
+	} else if oldFolder != "" {
+		if err = copyPublishedFolder(oldFolder, folderName, "discofeed"); err != nil {
+			return
+		}
+	}
+
+	if err = symlinkMetadataFolder(config["basefolder"]+"/"+config["symlinkfolder"], folderName); err != nil {
+		return
+	}
+	log.Printf("OK: published new generation %s", folderName)
+	return nil
+}
+
+// copyPublishedFolder copies a previously published feed subfolder forward into
+// the new generation untouched.
+func copyPublishedFolder(oldBase string, newBase string, name string) (err error) {
+	src := fmt.Sprintf("%s/%s", oldBase, name)
+	dst := fmt.Sprintf("%s/%s", newBase, name)
+
+	if _, err = os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relPath)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		_, err = io.Copy(out, in)
+		return err
+	})
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/wayf-dk/gosaml"
+)
+
+// discoEntry is one entry of a discofeed JSON document. It's kept as a generic
+// map rather than a fixed struct so fields we don't care about round-trip
+// untouched into the merged/per-entity output.
+type discoEntry map[string]interface{}
+
+// entityID returns the entry's entityID, or "" if it has none.
+func (e discoEntry) entityID() string {
+	id, _ := e["entityID"].(string)
+	return id
+}
+
+// registrationAuthority returns the entry's registration authority entityID,
+// or "" if it has none.
+func (e discoEntry) registrationAuthority() string {
+	auth, _ := e["auth"].(string)
+	return auth
+}
+
+// entityCategories returns the entry's entity categories.
+func (e discoEntry) entityCategories() []string {
+	raw, ok := e["entity_categories"].([]interface{})
+	if !ok {
+		return nil
+	}
+	categories := make([]string, 0, len(raw))
+	for _, c := range raw {
+		if s, ok := c.(string); ok {
+			categories = append(categories, s)
+		}
+	}
+	return categories
+}
+
+// matchesFilters reports whether e passes the configured entity category and
+// registration authority filters. An empty filter list matches everything.
+func (e discoEntry) matchesFilters(entityCategories []string, registrationAuthorities []string) bool {
+	if len(registrationAuthorities) > 0 {
+		auth := e.registrationAuthority()
+		found := false
+		for _, want := range registrationAuthorities {
+			if auth == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(entityCategories) > 0 {
+		have := e.entityCategories()
+		found := false
+		for _, want := range entityCategories {
+			for _, got := range have {
+				if got == want {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// localizedField resolves a language-keyed field (e.g. "title"), which may be
+// a plain string (no language info) or a language-keyed map, favouring "en".
+// It returns the picked value and the language it came from - "" if the
+// field was a plain string or absent.
+func localizedField(field interface{}) (value string, lang string) {
+	switch v := field.(type) {
+	case string:
+		return v, ""
+	case map[string]interface{}:
+		if en, ok := v["en"].(string); ok {
+			return en, "en"
+		}
+		for l, val := range v {
+			if s, ok := val.(string); ok {
+				return s, l
+			}
+		}
+	}
+	return "", ""
+}
+
+// displayName picks a human readable name out of the entry's "title", which
+// may be a plain string or a language-keyed map, favouring "en".
+func (e discoEntry) displayName() string {
+	value, _ := localizedField(e["title"])
+	return value
+}
+
+// language reports which language the picked displayName came from, or "" if
+// "title" was a plain string or absent.
+func (e discoEntry) language() string {
+	_, lang := localizedField(e["title"])
+	return lang
+}
+
+// logo picks a logo URL out of the entry's "icon", which may be a plain URL
+// string or a list of {url, width, height} objects.
+func (e discoEntry) logo() string {
+	switch v := e["icon"].(type) {
+	case string:
+		return v
+	case []interface{}:
+		if len(v) > 0 {
+			if m, ok := v[0].(map[string]interface{}); ok {
+				if url, ok := m["url"].(string); ok {
+					return url
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// indexEntry is the compact, per-entityID record written to index.jsgz so
+// discovery UIs can render a list without fetching every entry in full.
+type indexEntry struct {
+	DisplayName string `json:"displayName,omitempty"`
+	Logo        string `json:"logo,omitempty"`
+	Language    string `json:"language,omitempty"`
+}
+
+func (e discoEntry) toIndexEntry() indexEntry {
+	return indexEntry{DisplayName: e.displayName(), Logo: e.logo(), Language: e.language()}
+}
+
+// splitCSV splits a comma separated config value into its trimmed,
+// non-empty parts. An empty value yields a nil (i.e. "no filter") slice.
+func splitCSV(raw string) (parts []string) {
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return
+}
+
+// maybeGunzip transparently decompresses data if it looks gzip compressed
+// (phph.wayf.dk's discofeed is served as a .jsgz), otherwise it's returned
+// unchanged.
+func maybeGunzip(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
+
+// writeGzipFile writes data to path gzip compressed, preserving the .jsgz
+// naming convention already used for the upstream discofeed.
+func writeGzipFile(path string, data []byte) (err error) {
+	fd, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	gz := gzip.NewWriter(fd)
+	defer gz.Close()
+	_, err = gz.Write(data)
+	return
+}
+
+// mergeDiscoveryFeeds parses blobs (each individually gzip compressed or
+// plain JSON, per maybeGunzip), merges them into a single list of entries
+// deduplicated by entityID - first source wins on a collision - and filters
+// the result by entityCategories/registrationAuthorities (either may be nil
+// to skip that filter), then marshals the merged entries back to JSON.
+func mergeDiscoveryFeeds(blobs [][]byte, entityCategories []string, registrationAuthorities []string) (merged []byte, err error) {
+	seen := map[string]bool{}
+	var entries []discoEntry
+	for _, blob := range blobs {
+		raw, gunzipErr := maybeGunzip(blob)
+		if gunzipErr != nil {
+			return nil, gunzipErr
+		}
+		var feed []discoEntry
+		if err = json.Unmarshal(raw, &feed); err != nil {
+			return nil, fmt.Errorf("could not parse discovery feed: %s", err)
+		}
+		for _, entry := range feed {
+			id := entry.entityID()
+			if id == "" || seen[id] {
+				continue
+			}
+			if !entry.matchesFilters(entityCategories, registrationAuthorities) {
+				continue
+			}
+			seen[id] = true
+			entries = append(entries, entry)
+		}
+	}
+	return json.Marshal(entries)
+}
+
+// createDiscoServiceFile writes out the merged discovery feed produced by
+// mergeDiscoveryFeeds: the full feed gzip compressed at metadataPath/fileName
+// (preserving the .jsgz naming the upstream file already used), a compact
+// index of displayName/logo/language per entityID to accelerate discovery UIs, and a
+// per-entity split so a front-end can fetch just the entries it needs.
+// Everything lives under the feed's own subfolder so publish's
+// copyPublishedFolder(oldFolder, folderName, "discofeed") carries all of it
+// forward together on a generation where a metadata feed refreshed but
+// discovery itself didn't.
+func createDiscoServiceFile(data []byte, baseFolder string, feedName string, fileName string) (err error) {
+	var entries []discoEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("could not parse merged discovery feed: %s", err)
+	}
+
+	metadataPath := fmt.Sprintf("%s/%s", baseFolder, feedName)
+	if err = os.Mkdir(metadataPath, 0755); err != nil {
+		return
+	}
+
+	if err = writeGzipFile(fmt.Sprintf("%s/%s", metadataPath, fileName), data); err != nil {
+		return
+	}
+
+	index := make(map[string]indexEntry, len(entries))
+	for _, entry := range entries {
+		id := entry.entityID()
+		if id == "" {
+			continue
+		}
+		index[id] = entry.toIndexEntry()
+
+		entityJSON, marshalErr := json.Marshal(entry)
+		if marshalErr != nil {
+			return marshalErr
+		}
+		entityIDHashName := hex.EncodeToString(gosaml.Hash(crypto.SHA1, id))
+		if err = ioutil.WriteFile(fmt.Sprintf("%s/%s.json", metadataPath, entityIDHashName), entityJSON, 0644); err != nil {
+			return
+		}
+	}
+
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return
+	}
+	return writeGzipFile(fmt.Sprintf("%s/index.jsgz", metadataPath), indexJSON)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMergeDiscoveryFeedsDedupesFirstSourceWins(t *testing.T) {
+	first := []byte(`[{"entityID":"https://idp.example.org/a","title":"A"}]`)
+	second := []byte(`[{"entityID":"https://idp.example.org/a","title":"A-duplicate"},{"entityID":"https://idp.example.org/b","title":"B"}]`)
+
+	merged, err := mergeDiscoveryFeeds([][]byte{first, second}, nil, nil)
+	if err != nil {
+		t.Fatalf("mergeDiscoveryFeeds failed '%s'", err)
+	}
+
+	var entries []discoEntry
+	if err = json.Unmarshal(merged, &entries); err != nil {
+		t.Fatalf("could not parse merged output '%s'", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 merged entries, got %d", len(entries))
+	}
+	if entries[0].displayName() != "A" {
+		t.Errorf("expected first source to win on duplicate entityID, got title '%s'", entries[0].displayName())
+	}
+}
+
+func TestMergeDiscoveryFeedsFiltersByEntityCategory(t *testing.T) {
+	feed := []byte(`[
+		{"entityID":"https://idp.example.org/a","entity_categories":["http://refeds.org/category/research-and-scholarship"]},
+		{"entityID":"https://idp.example.org/b","entity_categories":["http://example.org/other"]}
+	]`)
+
+	merged, err := mergeDiscoveryFeeds([][]byte{feed}, []string{"http://refeds.org/category/research-and-scholarship"}, nil)
+	if err != nil {
+		t.Fatalf("mergeDiscoveryFeeds failed '%s'", err)
+	}
+
+	var entries []discoEntry
+	if err = json.Unmarshal(merged, &entries); err != nil {
+		t.Fatalf("could not parse merged output '%s'", err)
+	}
+	if len(entries) != 1 || entries[0].entityID() != "https://idp.example.org/a" {
+		t.Errorf("expected only the matching entity category to survive, got %v", entries)
+	}
+}
+
+func TestMergeDiscoveryFeedsFiltersByRegistrationAuthority(t *testing.T) {
+	feed := []byte(`[
+		{"entityID":"https://idp.example.org/a","auth":"https://wayf.dk"},
+		{"entityID":"https://idp.example.org/b","auth":"https://other.example.org"}
+	]`)
+
+	merged, err := mergeDiscoveryFeeds([][]byte{feed}, nil, []string{"https://wayf.dk"})
+	if err != nil {
+		t.Fatalf("mergeDiscoveryFeeds failed '%s'", err)
+	}
+
+	var entries []discoEntry
+	if err = json.Unmarshal(merged, &entries); err != nil {
+		t.Fatalf("could not parse merged output '%s'", err)
+	}
+	if len(entries) != 1 || entries[0].entityID() != "https://idp.example.org/a" {
+		t.Errorf("expected only the matching registration authority to survive, got %v", entries)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// atomicSwapSymlink points symlinkFolder at newTarget without ever leaving it
+// missing. It creates the new symlink under a temporary name next to
+// symlinkFolder and exchanges the two directory entries with
+// unix.Renameat2(RENAME_EXCHANGE), falling back to a plain rename on
+// filesystems that don't support it (still atomic, it just can't hand the old
+// target back for free).
+func atomicSwapSymlink(symlinkFolder string, newTarget string) (err error) {
+	tmp := symlinkFolder + ".next"
+	os.Remove(tmp) // left over from a crashed previous attempt, if any
+
+	if err = os.Symlink(newTarget, tmp); err != nil {
+		return
+	}
+
+	if _, statErr := os.Lstat(symlinkFolder); statErr != nil {
+		// Nothing to swap with yet - first publish. A plain rename is already atomic.
+		return os.Rename(tmp, symlinkFolder)
+	}
+
+	if err = unix.Renameat2(unix.AT_FDCWD, tmp, unix.AT_FDCWD, symlinkFolder, unix.RENAME_EXCHANGE); err != nil {
+		log.Printf("Renameat2(RENAME_EXCHANGE) not supported (%s), falling back to rename", err)
+		return os.Rename(tmp, symlinkFolder)
+	}
+
+	// tmp now holds whatever symlinkFolder pointed to before the swap; no longer needed.
+	return os.Remove(tmp)
+}
+
+// listGenerations returns the data folders below baseFolder matching
+// dataFolderNameFormat, oldest first.
+func listGenerations(baseFolder string, dataFolderNameFormat string) (folders []string, err error) {
+	folders, err = filepath.Glob(fmt.Sprintf("%s/%s*", baseFolder, dataFolderNameFormat))
+	if err != nil {
+		return
+	}
+	sort.Strings(folders)
+	return
+}
+
+// pruneGenerations removes all but the keep most recent generations below
+// baseFolder. keep <= 0 is treated as "keep everything".
+func pruneGenerations(baseFolder string, dataFolderNameFormat string, keep int) (err error) {
+	if keep <= 0 {
+		return nil
+	}
+	generations, err := listGenerations(baseFolder, dataFolderNameFormat)
+	if err != nil {
+		return
+	}
+	if len(generations) <= keep {
+		return nil
+	}
+	for _, old := range generations[:len(generations)-keep] {
+		if err = os.RemoveAll(old); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// rollback atomically swaps symlinkFolder back to the generation published
+// immediately before the one it currently points to.
+func rollback(baseFolder string, dataFolderNameFormat string, symlinkFolder string) (err error) {
+	current, err := filepath.EvalSymlinks(symlinkFolder)
+	if err != nil {
+		return fmt.Errorf("could not resolve current symlink: %s", err)
+	}
+
+	generations, err := listGenerations(baseFolder, dataFolderNameFormat)
+	if err != nil {
+		return
+	}
+
+	index := -1
+	for i, g := range generations {
+		if g == current {
+			index = i
+			break
+		}
+	}
+	if index <= 0 {
+		return fmt.Errorf("no earlier generation than %s available to roll back to", current)
+	}
+
+	previous := generations[index-1]
+	if err = atomicSwapSymlink(symlinkFolder, previous); err != nil {
+		return
+	}
+	log.Printf("Rolled back symlink from %s to %s", current, previous)
+	return nil
+}
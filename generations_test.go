@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAtomicSwapSymlinkFirstPublish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lmdq-generations")
+	if err != nil {
+		t.Fatalf("TempDir failed '%s'", err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "gen1")
+	if err = os.Mkdir(target, 0755); err != nil {
+		t.Fatalf("Mkdir failed '%s'", err)
+	}
+
+	symlink := filepath.Join(dir, "current")
+	if err = atomicSwapSymlink(symlink, target); err != nil {
+		t.Fatalf("atomicSwapSymlink failed '%s'", err)
+	}
+
+	resolved, err := filepath.EvalSymlinks(symlink)
+	if err != nil || resolved != target {
+		t.Errorf("symlink does not point at first generation, got '%s' err '%s'", resolved, err)
+	}
+}
+
+func TestAtomicSwapSymlinkSwapsExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lmdq-generations")
+	if err != nil {
+		t.Fatalf("TempDir failed '%s'", err)
+	}
+	defer os.RemoveAll(dir)
+
+	gen1 := filepath.Join(dir, "gen1")
+	gen2 := filepath.Join(dir, "gen2")
+	os.Mkdir(gen1, 0755)
+	os.Mkdir(gen2, 0755)
+
+	symlink := filepath.Join(dir, "current")
+	if err = atomicSwapSymlink(symlink, gen1); err != nil {
+		t.Fatalf("initial atomicSwapSymlink failed '%s'", err)
+	}
+	if err = atomicSwapSymlink(symlink, gen2); err != nil {
+		t.Fatalf("second atomicSwapSymlink failed '%s'", err)
+	}
+
+	resolved, err := filepath.EvalSymlinks(symlink)
+	if err != nil || resolved != gen2 {
+		t.Errorf("symlink does not point at second generation, got '%s' err '%s'", resolved, err)
+	}
+}
+
+func TestPruneGenerationsKeepsConfiguredCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lmdq-generations")
+	if err != nil {
+		t.Fatalf("TempDir failed '%s'", err)
+	}
+	defer os.RemoveAll(dir)
+
+	format := "lmdqdata_"
+	for i := 1; i <= 5; i++ {
+		if err = os.Mkdir(fmt.Sprintf("%s/%s%d", dir, format, i), 0755); err != nil {
+			t.Fatalf("Mkdir failed '%s'", err)
+		}
+	}
+
+	if err = pruneGenerations(dir, format, 2); err != nil {
+		t.Fatalf("pruneGenerations failed '%s'", err)
+	}
+
+	remaining, err := listGenerations(dir, format)
+	if err != nil {
+		t.Fatalf("listGenerations failed '%s'", err)
+	}
+	if len(remaining) != 2 {
+		t.Errorf("expected 2 generations to remain, got %d: %v", len(remaining), remaining)
+	}
+	for _, g := range remaining {
+		base := filepath.Base(g)
+		if base != format+"4" && base != format+"5" {
+			t.Errorf("unexpected generation kept: %s", g)
+		}
+	}
+}
+
+func TestRollbackTargetsPriorGeneration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lmdq-generations")
+	if err != nil {
+		t.Fatalf("TempDir failed '%s'", err)
+	}
+	defer os.RemoveAll(dir)
+
+	format := "lmdqdata_"
+	gen1 := fmt.Sprintf("%s/%s1", dir, format)
+	gen2 := fmt.Sprintf("%s/%s2", dir, format)
+	os.Mkdir(gen1, 0755)
+	os.Mkdir(gen2, 0755)
+
+	symlink := filepath.Join(dir, "current")
+	if err = atomicSwapSymlink(symlink, gen2); err != nil {
+		t.Fatalf("atomicSwapSymlink failed '%s'", err)
+	}
+
+	if err = rollback(dir, format, symlink); err != nil {
+		t.Fatalf("rollback failed '%s'", err)
+	}
+
+	resolved, err := filepath.EvalSymlinks(symlink)
+	if err != nil || resolved != gen1 {
+		t.Errorf("rollback did not target prior generation, got '%s' err '%s'", resolved, err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -26,8 +27,6 @@ Remove old folder
 
 health check
 log of updates
-Run as daemon
-Take updates intervals as environment
 Take location as environment
 Take folder basename and location as environment
 
@@ -39,21 +38,93 @@ Fetch json file for discovery service
 var config = map[string]string{
 	// example for metadataurl: hubpub::https://metadata.wayf.dk/wayf-metadata.xml::3c9a81a80e9032f888ba3cc7ac564364c38f283e;;hubpub2::https://metadata.wayf.dk/wayf-metadata.xml::3c9a81a80e9032f888ba3cc7ac564364c38f283e
 	// Each feed tuple consist of 'name::url::sslmodulushash' . Each tuple is seperated by ';;'
-	"metadataurl":          "",
+	// sslmodulushash may also be a comma separated list of hashes, a path to a local PEM
+	// trust bundle, or an http(s) URL to fetch one from - see resolveTrustAnchor.
+	"metadataurl": "",
+	// discoveryurl may be a single URL or, like metadataurl, a ';;' separated
+	// list of URLs. All of them are fetched, merged and deduplicated by
+	// entityID into one discofeed - see refreshDiscovery.
 	"discoveryurl":         "https://phph.wayf.dk/DS/wayf-interfed.discofeed.jsgz",
 	"basefolder":           "",
 	"datafoldernameformat": "lmdqdata_",
 	"symlinkfolder":        "lmdqdata",
 	// Use ws-federation.xsd to validate because its include both saml-schema-metadata-2.0.xsd and other metadata schemas
 	"metadataschemapath": "vendor/github.com/wayf-dk/gosaml/schemas/ws-federation.xsd",
+	// Default refresh interval in seconds for feeds that don't set their own in the metadataurl tuple
+	"refreshinterval": "3600",
+	// Refresh interval in seconds for the discovery feed
+	"discoveryinterval": "3600",
+	// Upper bound in seconds for the exponential backoff applied after a failed fetch
+	"maxbackoffseconds": "3600",
+	// Maximum +/- jitter in seconds applied to every scheduled refresh
+	"jitterseconds": "60",
+	// Number of past generations to keep under basefolder for --rollback, including the live one
+	"keepgenerations": "3",
+}
+
+// Optional config for the MDQ HTTP server. Unlike config these are allowed to
+// be empty - an empty "mdqlisten" simply means the server is not started.
+var httpConfig = map[string]string{
+	"mdqlisten":   "",
+	"signkeypath": "",
+	"metricspath": "/metrics",
+}
+
+// Set initial values for the optional HTTP server config. Kept separate from
+// initConfig as none of these are required.
+func initHTTPConfig() {
+	for k := range httpConfig {
+		if os.Getenv(k) != "" {
+			httpConfig[k] = os.Getenv(k)
+		}
+		log.Printf("Config: %s = %s", k, httpConfig[k])
+	}
+}
+
+// Optional config for filtering the merged discovery feed. Unlike config
+// these are allowed to be empty - an empty value means "no filter on that
+// dimension". Both are comma separated lists, see splitCSV.
+var discoveryConfig = map[string]string{
+	"discoveryentitycategories":      "",
+	"discoveryregistrationauthority": "",
+}
+
+// Set initial values for the optional discovery feed config. Kept separate
+// from initConfig as none of these are required.
+func initDiscoveryConfig() {
+	for k := range discoveryConfig {
+		if os.Getenv(k) != "" {
+			discoveryConfig[k] = os.Getenv(k)
+		}
+		log.Printf("Config: %s = %s", k, discoveryConfig[k])
+	}
 }
 
 type feedtuple struct {
-	name           string
-	url            string
+	name string
+	url  string
+	// sslmodulushash is the trust anchor as configured in the metadataurl tuple:
+	// a comma separated list of hashes, a path to a local PEM trust bundle, or a
+	// URL to fetch one from. See resolveTrustAnchor.
 	sslmodulushash string
+	// trust is sslmodulushash resolved into the set of key hashes/fingerprints
+	// that are acceptable for this feed. Listing more than one lets operators
+	// publish an overlap period while a signing key is rotated.
+	trust []string
+	// interval is this feed's own refresh interval. Zero means "use the
+	// 'refreshinterval' default".
+	interval time.Duration
+	// mode is either "aggregate" (the default - the whole feed is signed as one
+	// document) or "perEntity" (the aggregate itself is unsigned but every
+	// EntityDescriptor carries its own ds:Signature).
+	mode string
 }
 
+const (
+	feedModeAggregate = "aggregate"
+	feedModePerEntity = "perEntity"
+)
+
 var feeds []feedtuple
 
 // Set initial config values
@@ -74,95 +145,133 @@ func initConfig() {
 	}
 
 	// Populate the feed array
+	// Each tuple is 'name::url::sslmodulushash', optionally followed by any of:
+	//  - an interval in seconds, to override "refreshinterval" for that feed alone
+	//  - 'aggregate' or 'perEntity', to select how the feed's signature is checked (defaults to 'aggregate')
 	for _, feed := range strings.Split(config["metadataurl"], ";;") {
 		fau := strings.Split(feed, "::")
-		if len(fau) == 3 {
-			feedname := fau[0]
-			url := fau[1]
-			SSLmodulusHash := fau[2]
-			if feedname == "" || url == "" || SSLmodulusHash == "" {
-				log.Fatalf("Feed, url and hash string wrong '%s'", fau)
-			} else {
-				feeds = append(feeds, feedtuple{feedname, url, SSLmodulusHash})
-			}
-		} else {
+		if len(fau) < 3 {
 			log.Fatalf("Wrong feed format '%s'", feed)
 		}
+		feedname := fau[0]
+		url := fau[1]
+		SSLmodulusHash := fau[2]
+		if feedname == "" || url == "" || SSLmodulusHash == "" {
+			log.Fatalf("Feed, url and hash string wrong '%s'", fau)
+		}
+
+		interval := time.Duration(0)
+		mode := feedModeAggregate
+		for _, option := range fau[3:] {
+			switch {
+			case option == feedModeAggregate || option == feedModePerEntity:
+				mode = option
+			default:
+				seconds, err := strconv.Atoi(option)
+				if err != nil {
+					log.Fatalf("Wrong feed option '%s' in '%s'", option, fau)
+				}
+				interval = time.Duration(seconds) * time.Second
+			}
+		}
+
+		trust, err := resolveTrustAnchor(SSLmodulusHash)
+		if err != nil {
+			log.Fatalf("Wrong feed trust anchor '%s': %s", SSLmodulusHash, err)
+		}
+		feeds = append(feeds, feedtuple{feedname, url, SSLmodulusHash, trust, interval, mode})
 	}
 }
 
 // Create a new set of subfolders for MDQ metadata at the basefolder location.
-// It's named based on dataFolderNameFormat and a unix timestamp
-// It's a fatal error if the folder creation fails
+// It's named based on dataFolderNameFormat and a nanosecond timestamp. Since
+// chunk0-2, feeds publish independently of each other on their own schedules,
+// so two generations can legitimately be created within the same second;
+// UnixNano keeps them from colliding, and the retry loop covers the
+// vanishingly unlikely case of two calls landing on the exact same tick.
 func createDateTimeFolder(baseFolder string, dataFolderNameFormat string) (foldername string, err error) {
-	timenow := time.Now()
-	foldername = fmt.Sprintf("%s/%s%d", baseFolder, dataFolderNameFormat, timenow.Unix())
-	err = os.Mkdir(foldername, 0755)
-	if err != nil {
-		return "", fmt.Errorf("Create new datafolder %s failed", err)
+	for attempt := 0; attempt < 10; attempt++ {
+		foldername = fmt.Sprintf("%s/%s%d", baseFolder, dataFolderNameFormat, time.Now().UnixNano())
+		if err = os.Mkdir(foldername, 0755); err == nil {
+			return
+		}
+		if !os.IsExist(err) {
+			return "", fmt.Errorf("Create new datafolder %s failed", err)
+		}
 	}
-	return
+	return "", fmt.Errorf("Create new datafolder failed: %s already exists after retrying", foldername)
 }
 
-// Create or move the symlink pointer to the folder with the active metadata set
+// Move the symlink pointer to the folder with the active metadata set. The
+// swap itself is atomic (readers never see a missing symlinkFolder) and the
+// previous generations are kept around rather than removed immediately, so a
+// bad publish can be undone with --rollback. See atomicSwapSymlink and
+// pruneGenerations.
 func symlinkMetadataFolder(symlinkFolder string, newRealFolder string) (err error) {
-	var oldRealFolder string
-	createSymlink := true
-
-	oldRealFolder, err = filepath.EvalSymlinks(symlinkFolder)
-	// Symlink exists and shall not change
-	if err == nil && oldRealFolder == newRealFolder {
-		createSymlink = false
-	}
-
-	if createSymlink {
-		// Remove symlink before create a new one.
-		// Only remove if exists.
-		if _, err = os.Stat(symlinkFolder); err == nil {
-			err = os.Remove(symlinkFolder)
-			if err != nil {
-				return
-			}
-		}
-		// Create new symlink
-		err = os.Symlink(newRealFolder, symlinkFolder)
-		if err != nil {
-			return
-		}
+	oldRealFolder, evalErr := filepath.EvalSymlinks(symlinkFolder)
+	// Symlink exists and already points where we want it
+	if evalErr == nil && oldRealFolder == newRealFolder {
+		return nil
 	}
 
-	// Only cleanup if there exists a old folder. If old folder = nil then RemoveAll return no error
-	err = os.RemoveAll(oldRealFolder)
-	return
+	if err = atomicSwapSymlink(symlinkFolder, newRealFolder); err != nil {
+		return
+	}
+
+	keep, err := strconv.Atoi(config["keepgenerations"])
+	if err != nil {
+		return fmt.Errorf("invalid keepgenerations '%s': %s", config["keepgenerations"], err)
+	}
+	return pruneGenerations(filepath.Dir(symlinkFolder), config["datafoldernameformat"], keep)
 }
 
-func validateMetadata(metadata []byte, MetadataSchemaPath string, SSLmodulusHash string) (err error) {
+// validateMetadata schema-validates a feed and, in "aggregate" mode, checks the
+// signature over the whole document against any of the feed's configured
+// trust anchors. In "perEntity" mode the aggregate itself is expected to be
+// unsigned - each EntityDescriptor's own signature is checked later, per
+// entity, by createMDQFiles.
+func validateMetadata(metadata []byte, MetadataSchemaPath string, trust []string, mode string, feedName string) (err error) {
 	dom := gosaml.NewXp(metadata)
 	_, err = dom.SchemaValidate(MetadataSchemaPath)
 	if err != nil {
 		return
 	}
 
+	if mode == feedModePerEntity {
+		return nil
+	}
+
 	certificate := dom.Query(nil, "(/md:EntitiesDescriptor|/md:EntityDescriptor)/ds:Signature/ds:KeyInfo/ds:X509Data/ds:X509Certificate")
 	if len(certificate) != 1 {
 		err = fmt.Errorf("Metadata not signed")
 		return
 	}
-	keyname, key, err := gosaml.PublicKeyInfo(dom.NodeGetContent(certificate[0]))
-
+	certB64 := dom.NodeGetContent(certificate[0])
+	keyname, key, err := gosaml.PublicKeyInfo(certB64)
 	if err != nil {
 		return
 	}
+
+	matchedAnchor, sha256Fingerprint, err := matchTrustAnchor(certB64, keyname, trust)
+	if err != nil {
+		return fmt.Errorf("Signature check failed. Signature %s, %s = %s", err, keyname, strings.Join(trust, ","))
+	}
+
 	ok := dom.VerifySignature(nil, key)
-	if ok != nil || keyname != SSLmodulusHash {
-		return fmt.Errorf("Signature check failed. Signature %s, %s = %s", ok, keyname, SSLmodulusHash)
+	if ok != nil {
+		return fmt.Errorf("Signature check failed. Signature %s, %s = %s", ok, keyname, matchedAnchor)
 	}
-	return
+	log.Printf("lMDQ: feed '%s' verified with trust anchor %s (sha256 %s)", feedName, matchedAnchor, sha256Fingerprint)
+	setActiveKeyID(feedName, matchedAnchor)
+	return nil
 }
 
 // Fetch one metadata set. Call it for each metadata set.
 // Get - insecure Get if https is used, doesn't matter for metadata as we check the signature anyway
-func fetchData(url string) (data []byte, err error) {
+// etag and lastModified, if non-empty, are sent as If-None-Match/If-Modified-Since so an
+// unchanged upstream aggregate can be skipped with a 304. notModified reports whether that
+// happened; newETag/newLastModified carry the values to remember for the next call.
+func fetchData(url string, etag string, lastModified string) (data []byte, notModified bool, newETag string, newLastModified string, err error) {
 	var resp *http.Response
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
@@ -171,37 +280,33 @@ func fetchData(url string) (data []byte, err error) {
 		Transport: tr,
 	}
 
-	resp, err = client.Get(url)
-	if resp != nil {
-		defer resp.Body.Close()
-	}
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Status code: %d (%s)", resp.StatusCode, url)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
 	}
-	data, err = ioutil.ReadAll(resp.Body)
-	return
-}
-
-func createDiscoServiceFile(data []byte, baseFolder string, feedName string, fileName string) (err error) {
-	dataPath := fmt.Sprintf("%s/%s", baseFolder, feedName)
-
-	// Create subdir for feed
-	err = os.Mkdir(dataPath, 0755)
-	if err != nil {
-		log.Fatalf("ERROR: subdir '%s': %s", dataPath, err)
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
 	}
 
-	fd, err := os.Create(fmt.Sprintf("%s/%s", dataPath, fileName))
-	if fd != nil {
-		defer fd.Close()
+	resp, err = client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
 	}
 	if err != nil {
 		return
 	}
-	_, err = fd.Write(data)
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, true, etag, lastModified, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, "", "", fmt.Errorf("Status code: %d (%s)", resp.StatusCode, url)
+	}
+	data, err = ioutil.ReadAll(resp.Body)
+	newETag = resp.Header.Get("ETag")
+	newLastModified = resp.Header.Get("Last-Modified")
 	return
 }
 
@@ -219,27 +324,65 @@ func createEntityFile(entityMetadata []byte, dirpath string, filename string) (e
 	return
 }
 
-func createMDQFiles(metadata []byte, baseFolder string, feedName string) (err error) {
+// createMDQFiles splits a feed into per-entity MDQ files. In "perEntity" mode
+// the aggregate itself carries no signature, so each entity is individually
+// checked against the feed's trust anchors before being written out; entities
+// that fail are skipped and logged rather than aborting the whole feed, unless
+// every entity fails, in which case an error is returned.
+func createMDQFiles(metadata []byte, baseFolder string, feedName string, trust []string, mode string) (entityCount int, err error) {
 	var indextargets []string = []string{
 		"./md:IDPSSODescriptor/md:SingleSignOnService[@Binding='urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect']/@Location",
 		// "./md:SPSSODescriptor/md:AssertionConsumerService[@Binding='urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST']/@Location",
 	}
 	metadataPath := fmt.Sprintf("%s/%s", baseFolder, feedName)
 
-	// Create subdir for feed
-	err = os.Mkdir(metadataPath, 0755)
+	// Create subdir for feed. A transient failure here (ENOSPC, a permissions
+	// hiccup, ...) must not take down the daemon - return it like every other
+	// error in this function so refreshFeed's backoff/retry handles it.
+	if err = os.Mkdir(metadataPath, 0755); err != nil {
+		return 0, fmt.Errorf("subdir '%s': %s", metadataPath, err)
+	}
+
+	// Keep the aggregate as fetched (unsigned in "perEntity" mode) so it can be served as-is by the MDQ server
+	err = ioutil.WriteFile(fmt.Sprintf("%s/aggregate.xml", metadataPath), metadata, 0644)
 	if err != nil {
-		log.Fatalf("ERROR: subdir '%s': %s", metadataPath, err)
+		return
 	}
 
 	dom := gosaml.NewXp(metadata)
 	entities := dom.Query(nil, "(/md:EntityDescriptor|/md:EntitiesDescriptor/md:EntityDescriptor)")
+	var lastMatchedAnchor string
 	for _, entity := range entities {
+		entityID := dom.Query1(entity, "@entityID")
+
+		if mode == feedModePerEntity {
+			certificate := dom.Query(entity, "./ds:Signature/ds:KeyInfo/ds:X509Data/ds:X509Certificate")
+			if len(certificate) != 1 {
+				log.Printf("lMDQ: skipping entity '%s': not signed", entityID)
+				continue
+			}
+			certB64 := dom.NodeGetContent(certificate[0])
+			keyname, key, keyErr := gosaml.PublicKeyInfo(certB64)
+			if keyErr != nil {
+				log.Printf("lMDQ: skipping entity '%s': %s", entityID, keyErr)
+				continue
+			}
+			matchedAnchor, _, matchErr := matchTrustAnchor(certB64, keyname, trust)
+			if matchErr != nil {
+				log.Printf("lMDQ: skipping entity '%s': %s", entityID, matchErr)
+				continue
+			}
+			if ok := dom.VerifySignature(entity, key); ok != nil {
+				log.Printf("lMDQ: skipping entity '%s': signature check failed. Signature %s, %s = %s", entityID, ok, keyname, matchedAnchor)
+				continue
+			}
+			lastMatchedAnchor = matchedAnchor
+		}
+
 		// Create new dom with metadata sniptet for this entity
 		entityMetadata := gosaml.NewXpFromNode(entity).X2s()
 
 		// Find the entityID and write metadata snipet to hash of entityID as filename
-		entityID := dom.Query1(entity, "@entityID")
 		// if seen[entityID] {
 		// 	log.Printf("lMDQ duplicate entityID: %s", entityID)
 		// 	continue
@@ -261,48 +404,38 @@ func createMDQFiles(metadata []byte, baseFolder string, feedName string) (err er
 				}
 			}
 		}
+		entityCount++
+	}
+	if mode == feedModePerEntity {
+		// If every entity present failed verification (a typo'd trust anchor, or
+		// a key rollover where the old cert was fully retired) we'd otherwise
+		// report success with an empty feed and silently wipe out whatever was
+		// previously published. Fail instead so refreshFeed backs off and the
+		// previous generation keeps serving.
+		if len(entities) > 0 && entityCount == 0 {
+			return 0, fmt.Errorf("0 of %d entities verified for feed '%s', refusing to publish an empty feed", len(entities), feedName)
+		}
+		if lastMatchedAnchor != "" {
+			setActiveKeyID(feedName, lastMatchedAnchor)
+		}
 	}
 	return
 }
 
 func main() {
-	var discoServiceData []byte
-	var body []byte
-	var err error
-
 	initConfig()
-	folderName, err := createDateTimeFolder(config["basefolder"], config["datafoldernameformat"])
-	if err != nil {
-		log.Fatalf("ERROR: %s", err)
-	}
-
-	// fmt.Printf("fau: %v\n url: %s\n feedname: %s\n", fau, url, feedname)
-	for _, feed := range feeds {
-		body, err = fetchData(feed.url)
-		if err != nil {
-			log.Fatalf("ERROR: %s", err)
-		}
-		if err = validateMetadata(body, config["metadataschemapath"], feed.sslmodulushash); err != nil {
-			log.Fatalf("ERROR: %s", err)
-		}
-		err = createMDQFiles(body, folderName, feed.name)
-		if err != nil {
-			log.Fatalf("ERROR: %s", err)
+	initHTTPConfig()
+	initDiscoveryConfig()
+
+	// --rollback atomically points the symlink back at the previous generation
+	// and exits, for fast recovery after a bad feed got published.
+	if len(os.Args) > 1 && os.Args[1] == "--rollback" {
+		if err := rollback(config["basefolder"], config["datafoldernameformat"], config["basefolder"]+"/"+config["symlinkfolder"]); err != nil {
+			log.Fatalf("ERROR: rollback failed: %s", err)
 		}
-	}
-	// Fetch discovery service file. Hardcode subdir name to discoservice
-	if discoServiceData, err = fetchData(config["discoveryurl"]); err != nil {
-		log.Fatalf("ERROR: %s", err)
-	}
-
-	if err = createDiscoServiceFile(discoServiceData, folderName, "discofeed", "wayf-interfed.discofeed.jsgz"); err != nil {
-		log.Fatalf("ERROR: %s", err)
+		log.Printf("OK: rolled back to previous generation")
+		return
 	}
 
-	// When all works then move the symlink pointer and remove the old folder
-	err = symlinkMetadataFolder(config["basefolder"]+"/"+config["symlinkfolder"], folderName)
-	if err != nil {
-		log.Fatalf("ERROR: %s", err)
-	}
-    log.Printf("OK: lMDQ update succesfull. New folder is %s", folderName)
+	runDaemon()
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"io/ioutil"
+	"log"
 	"os"
 	"testing"
 
@@ -21,13 +22,15 @@ func TestMain(m *testing.M) {
 	var err error
 	metadata, err = ioutil.ReadFile("metadata_test.xml")
 	if err != nil {
-		return
+		// A missing fixture must fail the run loudly rather than report a
+		// clean pass having executed zero tests.
+		log.Fatalf("could not read metadata_test.xml: %s", err)
 	}
 	os.Exit(m.Run())
 }
 
 func TestValidateMetadataNotValidDocument(t *testing.T) {
-	err := validateMetadata(metadata[:30], schemaPath, SSLmodulusHash)
+	err := validateMetadata(metadata[:30], schemaPath, []string{SSLmodulusHash}, feedModeAggregate, "test")
 	if err.Error() != "Document validation error -1" {
 		t.Errorf("Document not validation failed '%s'", err)
 	}
@@ -35,7 +38,7 @@ func TestValidateMetadataNotValidDocument(t *testing.T) {
 
 func TestValidateMetadataWrongSchema(t *testing.T) {
 	// Validate with a wrong schema to verify that it fails
-	err := validateMetadata(metadata, wrongSchema, SSLmodulusHash)
+	err := validateMetadata(metadata, wrongSchema, []string{SSLmodulusHash}, feedModeAggregate, "test")
 	// If no error or the wrong error then fail
 	if err == nil || err.Error() != "Document validation error 1845" {
 		t.Errorf("Wrong schema validation failed '%s'", err)
@@ -46,7 +49,7 @@ func TestValidateMetadataWrongDigest(t *testing.T) {
 	dom := gosaml.NewXp(metadata)
 	dom.QueryDashP(nil, "/./ds:Signature/ds:SignedInfo/ds:Reference/ds:DigestValue[1]", "+dPr0aJZ4IF5ovxAe7Uss+xBu0UNdtgoHq9CppyH2Vs=", nil)
 	metadata2 := []byte(dom.Pp())
-	err := validateMetadata(metadata2, schemaPath, SSLmodulusHash)
+	err := validateMetadata(metadata2, schemaPath, []string{SSLmodulusHash}, feedModeAggregate, "test")
 	if err.Error() != "Signature check failed. Signature digest mismatch, 3c9a81a80e9032f888ba3cc7ac564364c38f283e = 3c9a81a80e9032f888ba3cc7ac564364c38f283e" {
 		t.Errorf("Wrong digest failed '%s'", err)
 	}
@@ -54,7 +57,7 @@ func TestValidateMetadataWrongDigest(t *testing.T) {
 
 // Catch all validation test
 func TestValidateMetadata(t *testing.T) {
-	err := validateMetadata(metadata, schemaPath, SSLmodulusHash)
+	err := validateMetadata(metadata, schemaPath, []string{SSLmodulusHash}, feedModeAggregate, "test")
 	if err != nil {
 		t.Errorf("Document not valided '%s'", err)
 	}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wayf-dk/gosaml"
+)
+
+// feedStatus holds the last known health of a single feed for the /status endpoint.
+type feedStatus struct {
+	LastSuccess time.Time `json:"last_success"`
+	Entities    int       `json:"entities"`
+}
+
+var (
+	statusLock sync.RWMutex
+	status     = map[string]*feedStatus{}
+)
+
+// recordFeedStatus updates the status entry for a feed after a successful publish.
+func recordFeedStatus(feedName string, entityCount int) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	status[feedName] = &feedStatus{LastSuccess: time.Now(), Entities: entityCount}
+}
+
+// mdqServer serves the currently published MDQ tree, implementing the SAML
+// Metadata Query Protocol (draft-young-md-query) on top of the files written
+// by createMDQFiles.
+type mdqServer struct {
+	symlinkFolder string
+	signKey       *rsa.PrivateKey // nil disables per-entity re-signing
+}
+
+// newMDQServer creates a mdqServer that serves files published below symlinkFolder.
+// signKeyPath may be empty, in which case entities are served exactly as written to disk.
+func newMDQServer(symlinkFolder string, signKeyPath string) (s *mdqServer, err error) {
+	s = &mdqServer{symlinkFolder: symlinkFolder}
+	if signKeyPath == "" {
+		return
+	}
+	s.signKey, err = loadSigningKey(signKeyPath)
+	return
+}
+
+// loadSigningKey reads a PEM encoded RSA private key used to re-sign individual
+// entities on the fly.
+func loadSigningKey(path string) (key *rsa.PrivateKey, err error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+	if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse private key %s: %s", path, err)
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA private key", path)
+	}
+	return rsaKey, nil
+}
+
+// ServeMux builds the http.Handler exposing the MDQ endpoints.
+func (s *mdqServer) ServeMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/entities/", s.entitiesHandler)
+	mux.HandleFunc("/status", s.statusHandler)
+	if path := httpConfig["metricspath"]; path != "" {
+		mux.HandleFunc(path, metricsHandler)
+	}
+	return mux
+}
+
+// entitiesHandler dispatches between the aggregate endpoint ("/entities/") and
+// single entity lookups ("/entities/{sha1:...}" or "/entities/{urlencoded-entityID}").
+func (s *mdqServer) entitiesHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/entities/")
+	if id == "" {
+		s.aggregateHandler(w, r)
+		return
+	}
+
+	var hashName string
+	if strings.HasPrefix(id, "sha1:") {
+		hashName = strings.TrimPrefix(id, "sha1:")
+	} else {
+		entityID, err := url.QueryUnescape(id)
+		if err != nil {
+			http.Error(w, "malformed entityID", http.StatusBadRequest)
+			return
+		}
+		hashName = hex.EncodeToString(gosaml.Hash(crypto.SHA1, entityID))
+	}
+
+	realFolder, err := filepath.EvalSymlinks(s.symlinkFolder)
+	if err != nil {
+		http.Error(w, "metadata not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	matches, err := filepath.Glob(fmt.Sprintf("%s/*/{sha1}%s", realFolder, hashName))
+	if err != nil || len(matches) == 0 {
+		http.Error(w, "entity not found", http.StatusNotFound)
+		return
+	}
+
+	s.serveMetadataFile(w, r, matches[0], s.signKey != nil)
+}
+
+// serveMetadataFile writes out a metadata file with ETag/Last-Modified/
+// Cache-Control handling, re-signing it first if reSign is set and a signing
+// key is configured.
+func (s *mdqServer) serveMetadataFile(w http.ResponseWriter, r *http.Request, path string, reSign bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		http.Error(w, "entity not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		http.Error(w, "could not read entity", http.StatusInternalServerError)
+		return
+	}
+
+	if reSign && s.signKey != nil {
+		if data, err = resignEntity(data, s.signKey); err != nil {
+			log.Printf("ERROR: could not re-sign %s: %s", path, err)
+			http.Error(w, "could not sign entity", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	etag := fmt.Sprintf(`"%s"`, hex.EncodeToString(gosaml.Hash(crypto.SHA1, string(data))))
+	if match := r.Header.Get("If-None-Match"); match != "" && match == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(data)
+}
+
+// resignEntity replaces whatever signature is already on an entity snippet
+// with a fresh one from key, so individual MDQ responses can be verified on
+// their own rather than relying on the signature over the full aggregate.
+func resignEntity(entityMetadata []byte, key *rsa.PrivateKey) (signed []byte, err error) {
+	dom := gosaml.NewXp(entityMetadata)
+	root := dom.Query(nil, "/md:EntityDescriptor")
+	if len(root) != 1 {
+		return nil, fmt.Errorf("expected a single EntityDescriptor")
+	}
+	if err = dom.Sign(root[0], key); err != nil {
+		return
+	}
+	return []byte(dom.X2s()), nil
+}
+
+// aggregateHandler serves the aggregate for a single feed as it was fetched,
+// selected with ?feed=name and defaulting to the first configured feed.
+func (s *mdqServer) aggregateHandler(w http.ResponseWriter, r *http.Request) {
+	feedName := r.URL.Query().Get("feed")
+	if feedName == "" {
+		if len(feeds) == 0 {
+			http.Error(w, "no feeds configured", http.StatusServiceUnavailable)
+			return
+		}
+		feedName = feeds[0].name
+	}
+
+	realFolder, err := filepath.EvalSymlinks(s.symlinkFolder)
+	if err != nil {
+		http.Error(w, "metadata not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	s.serveMetadataFile(w, r, fmt.Sprintf("%s/%s/aggregate.xml", realFolder, feedName), false)
+}
+
+// statusHandler reports the last successful fetch time and entity count per feed.
+func (s *mdqServer) statusHandler(w http.ResponseWriter, r *http.Request) {
+	statusLock.RLock()
+	defer statusLock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		http.Error(w, "could not encode status", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/wayf-dk/gosaml"
+)
+
+// resolveTrustAnchor expands a feedtuple's trust anchor configuration into the
+// set of acceptable key hashes/fingerprints. raw may be:
+//   - a comma separated list of hashes (the historical single-hash form still works)
+//   - a path to a local PEM file containing one or more signing certificates
+//   - an http(s) URL to fetch such a PEM bundle from
+//
+// Listing more than one hash, or a bundle with more than one certificate, lets
+// operators publish an overlap period while a signing key is rotated.
+func resolveTrustAnchor(raw string) (trust []string, err error) {
+	if strings.HasPrefix(raw, "http://") || strings.HasPrefix(raw, "https://") {
+		pemBytes, _, _, _, fetchErr := fetchData(raw, "", "")
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		return trustAnchorsFromPEM(pemBytes)
+	}
+
+	if info, statErr := os.Stat(raw); statErr == nil && !info.IsDir() {
+		pemBytes, readErr := ioutil.ReadFile(raw)
+		if readErr != nil {
+			return nil, readErr
+		}
+		return trustAnchorsFromPEM(pemBytes)
+	}
+
+	for _, hash := range strings.Split(raw, ",") {
+		hash = strings.TrimSpace(hash)
+		if hash != "" {
+			trust = append(trust, hash)
+		}
+	}
+	if len(trust) == 0 {
+		return nil, fmt.Errorf("no usable trust anchor in '%s'", raw)
+	}
+	return
+}
+
+// trustAnchorsFromPEM computes both a SHA-1 modulus hash (matching gosaml's
+// existing PublicKeyInfo keyname) and a SHA-256 SubjectKeyIdentifier-style
+// fingerprint for every certificate in a PEM bundle, so either identifier can
+// be used to pin trust.
+func trustAnchorsFromPEM(pemBytes []byte) (trust []string, err error) {
+	rest := pemBytes
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		certB64 := base64.StdEncoding.EncodeToString(block.Bytes)
+		keyname, _, keyErr := gosaml.PublicKeyInfo(certB64)
+		if keyErr != nil {
+			return nil, keyErr
+		}
+		sha256Fingerprint, fpErr := certSHA256Fingerprint(certB64)
+		if fpErr != nil {
+			return nil, fpErr
+		}
+		trust = append(trust, keyname, sha256Fingerprint)
+	}
+	if len(trust) == 0 {
+		return nil, fmt.Errorf("no certificates found in trust bundle")
+	}
+	return
+}
+
+// certSHA256Fingerprint computes a SHA-256 fingerprint of a certificate's
+// SubjectPublicKeyInfo, so key rollover can be pinned with a stronger
+// identifier than the SHA-1 modulus hash alone.
+func certSHA256Fingerprint(certB64 string) (fingerprint string, err error) {
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(certB64))
+	if err != nil {
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// matchTrustAnchor reports which of trust's configured hashes, if any, matches
+// a certificate - trying both gosaml's own SHA-1 modulus keyname and an
+// independently computed SHA-256 fingerprint.
+func matchTrustAnchor(certB64 string, keyname string, trust []string) (matchedAnchor string, sha256Fingerprint string, err error) {
+	sha256Fingerprint, err = certSHA256Fingerprint(certB64)
+	if err != nil {
+		return
+	}
+	for _, candidate := range trust {
+		if candidate == keyname || candidate == sha256Fingerprint {
+			return candidate, sha256Fingerprint, nil
+		}
+	}
+	return "", sha256Fingerprint, fmt.Errorf("no configured trust anchor matched (sha1-modulus %s, sha256 %s)", keyname, sha256Fingerprint)
+}